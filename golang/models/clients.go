@@ -0,0 +1,91 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// Clients holds the long-lived singletons that order.go used to dial fresh on
+// every request: the OrderStore (MongoDB/CosmosDB or SQL - see store.go) and
+// the AMQP Publisher (which owns its own amqp091/amqp10 connection - see
+// publisher.go).
+type Clients struct {
+	Store     OrderStore
+	Publisher *Publisher
+}
+
+// NewClients dials the order store and AMQP once and returns the shared
+// singletons. Call Shutdown when the process is stopping so in-flight work
+// can drain.
+func NewClients(ctx context.Context) (*Clients, error) {
+	store, err := dialStore()
+	if err != nil {
+		return nil, fmt.Errorf("clients: store: %w", err)
+	}
+
+	if err := prepareAMQP(); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("clients: amqp: %w", err)
+	}
+
+	publisher, err := NewPublisher(DefaultPublisherConfig(amqpURL))
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("clients: amqp: %w", err)
+	}
+
+	return &Clients{Store: store, Publisher: publisher}, nil
+}
+
+// Shutdown drains in-flight publishes, closes the AMQP connection, then closes
+// the order store, in that order so nothing is left publishing against a
+// store that's already gone.
+func (c *Clients) Shutdown(ctx context.Context) error {
+	return shutdownClients(ctx, c.Publisher, c.Store)
+}
+
+// closer is the narrow Close() error shape shared by Publisher and
+// OrderStore, so shutdownClients' drain/close ordering can be unit tested
+// with small fakes instead of a live broker and database.
+type closer interface {
+	Close() error
+}
+
+// shutdownClients closes amqp before the store: the publisher's Close already
+// waits for its worker goroutine to finish any in-flight publish, so by the
+// time the store closes no publish can still be referencing it.
+func shutdownClients(ctx context.Context, amqp closer, store closer) error {
+	done := make(chan error, 1)
+	go func() { done <- amqp.Close() }()
+
+	select {
+	case err := <-done:
+		store.Close()
+		return err
+	case <-ctx.Done():
+		store.Close()
+		return ctx.Err()
+	}
+}
+
+// prepareAMQP parses amqpURL, logs which backend we're talking to, and fills
+// in eventHubName/queue path ahead of constructing the Publisher.
+func prepareAMQP() error {
+	parsed, err := url.Parse(amqpURL)
+	if err != nil {
+		if customTelemetryClient != nil {
+			customTelemetryClient.TrackException(err)
+		}
+		return fmt.Errorf("parsing AMQP URL: %w", err)
+	}
+
+	logger.Info("Using " + queueType.String())
+	if queueType == QueueTypeEventHub || queueType == QueueTypeServiceBus {
+		// Parse the eventHubName/queue name (last part of the url)
+		eventHubName = parsed.Path
+	}
+	logger.Debug("\tAMQP URL: " + redactURL(amqpURL))
+
+	return nil
+}
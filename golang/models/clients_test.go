@@ -0,0 +1,76 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakeCloser stands in for Publisher/OrderStore so shutdownClients' ordering
+// and error-propagation can be tested without a live broker or database.
+type fakeCloser struct {
+	closed  bool
+	closeAt func() // invoked from within Close, to observe ordering
+	err     error
+}
+
+func (f *fakeCloser) Close() error {
+	f.closed = true
+	if f.closeAt != nil {
+		f.closeAt()
+	}
+	return f.err
+}
+
+func TestShutdownClientsClosesAMQPBeforeStore(t *testing.T) {
+	amqp := &fakeCloser{}
+	var amqpClosedBeforeStore bool
+	store := &fakeCloser{closeAt: func() { amqpClosedBeforeStore = amqp.closed }}
+
+	if err := shutdownClients(context.Background(), amqp, store); err != nil {
+		t.Fatalf("shutdownClients returned error: %v", err)
+	}
+
+	if !amqp.closed {
+		t.Error("expected amqp to be closed")
+	}
+	if !store.closed {
+		t.Error("expected store to be closed")
+	}
+	if !amqpClosedBeforeStore {
+		t.Error("expected amqp to be closed before the store")
+	}
+}
+
+func TestShutdownClientsPropagatesAMQPError(t *testing.T) {
+	wantErr := errors.New("boom")
+	amqp := &fakeCloser{err: wantErr}
+	store := &fakeCloser{}
+
+	err := shutdownClients(context.Background(), amqp, store)
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("got error %v, want %v", err, wantErr)
+	}
+	if !store.closed {
+		t.Error("expected store to still be closed even when amqp.Close fails")
+	}
+}
+
+func TestShutdownClientsRespectsContextDeadline(t *testing.T) {
+	amqp := &fakeCloser{closeAt: func() {
+		// Simulate a publisher whose worker never drains in time.
+		select {}
+	}}
+	store := &fakeCloser{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := shutdownClients(ctx, amqp, store)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+	if !store.closed {
+		t.Error("expected store to be closed even when amqp shutdown times out")
+	}
+}
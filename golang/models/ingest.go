@@ -0,0 +1,223 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus counters for sizing the ingestion pool. Exported on /metrics via
+// MetricsHandler.
+var (
+	ordersEnqueuedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orders_enqueued_total",
+		Help: "Orders accepted onto the ingestion queue.",
+	})
+	ordersFlushedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orders_flushed_total",
+		Help: "Orders written and published as part of a batch.",
+	})
+	ordersDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orders_dropped_total",
+		Help: "Orders rejected because the ingestion queue was full.",
+	})
+	batchSizeHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "batch_size_histogram",
+		Help:    "Number of orders flushed per batch.",
+		Buckets: prometheus.LinearBuckets(1, 5, 10),
+	})
+)
+
+// MetricsHandler exposes the counters above. The HTTP server should mount it
+// at /metrics.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Ingestor batches what used to be an inline AddOrderToMongoDB+AddOrderToAMQP
+// call per request into a single bulk store write and a single AMQP publish
+// per batch, so the ingestion throughput isn't bound by per-order network
+// round trips.
+type Ingestor struct {
+	cfg   IngestorConfig
+	queue chan Order
+
+	wg       sync.WaitGroup
+	stopping chan struct{}
+}
+
+// IngestorConfig controls the queue depth, batching thresholds and worker
+// pool size of an Ingestor.
+type IngestorConfig struct {
+	QueueSize   int           // depth of the bounded EnqueueOrder buffer
+	BatchSize   int           // flush once a batch reaches this many orders
+	BatchWindow time.Duration // flush a partial batch after this long
+	Workers     int           // number of goroutines draining the queue
+}
+
+// DefaultIngestorConfig reads WORKERS from the environment (default
+// runtime.NumCPU()) and otherwise returns sane batching defaults.
+func DefaultIngestorConfig() IngestorConfig {
+	workers := runtime.NumCPU()
+	if w, err := strconv.Atoi(os.Getenv("WORKERS")); err == nil && w > 0 {
+		workers = w
+	}
+
+	return IngestorConfig{
+		QueueSize:   1024,
+		BatchSize:   50,
+		BatchWindow: 100 * time.Millisecond,
+		Workers:     workers,
+	}
+}
+
+// NewIngestor starts cfg.Workers worker goroutines, each draining the shared
+// queue in batches of up to cfg.BatchSize orders or cfg.BatchWindow,
+// whichever comes first.
+func NewIngestor(cfg IngestorConfig) *Ingestor {
+	in := &Ingestor{
+		cfg:      cfg,
+		queue:    make(chan Order, cfg.QueueSize),
+		stopping: make(chan struct{}),
+	}
+
+	for i := 0; i < cfg.Workers; i++ {
+		in.wg.Add(1)
+		go in.worker()
+	}
+
+	return in
+}
+
+// EnqueueOrder hands order to the ingestion queue for batched insert/publish.
+// It never blocks the caller: if the queue is full, or Shutdown has already
+// been called, it returns an error immediately so the HTTP handler can answer
+// with a 503 instead of stalling the request goroutine or accepting an order
+// nobody is left to flush.
+func (in *Ingestor) EnqueueOrder(order Order) error {
+	// Checked on its own first: in a single select a free queue slot could
+	// win over an already-closed stopping channel.
+	select {
+	case <-in.stopping:
+		ordersDroppedTotal.Inc()
+		return fmt.Errorf("ingestor: shutting down, dropping order %s", order.ID)
+	default:
+	}
+
+	select {
+	case in.queue <- order:
+		ordersEnqueuedTotal.Inc()
+		return nil
+	default:
+		ordersDroppedTotal.Inc()
+		return fmt.Errorf("ingestor: queue full, dropping order %s", order.ID)
+	}
+}
+
+// worker batches orders off the shared queue and flushes whichever comes
+// first: cfg.BatchSize orders, or cfg.BatchWindow since the last flush.
+func (in *Ingestor) worker() {
+	defer in.wg.Done()
+
+	batch := make([]Order, 0, in.cfg.BatchSize)
+	timer := time.NewTimer(in.cfg.BatchWindow)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		flushBatch(batch)
+		batchSizeHistogram.Observe(float64(len(batch)))
+		ordersFlushedTotal.Add(float64(len(batch)))
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case order := <-in.queue:
+			batch = append(batch, order)
+			if len(batch) >= in.cfg.BatchSize {
+				flush()
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(in.cfg.BatchWindow)
+			}
+
+		case <-timer.C:
+			flush()
+			timer.Reset(in.cfg.BatchWindow)
+
+		case <-in.stopping:
+			// Drain whatever is already queued, then flush and exit - this is
+			// Shutdown's flush-with-a-deadline; the deadline itself is
+			// enforced by Shutdown racing this against ctx.Done().
+			for {
+				select {
+				case order := <-in.queue:
+					batch = append(batch, order)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown stops accepting new batches, flushes whatever is already queued,
+// and waits for every worker to exit - but not past ctx's deadline, so a
+// slow flush can't hang process shutdown forever.
+func (in *Ingestor) Shutdown(ctx context.Context) error {
+	close(in.stopping)
+
+	done := make(chan struct{})
+	go func() {
+		in.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flushBatch bulk-inserts batch into the order store, then publishes the
+// resulting IDs as a single AMQP message instead of one per order.
+func flushBatch(batch []Order) {
+	ctx := context.Background()
+
+	inserted, err := clients.Store.InsertBatch(ctx, batch)
+	if err != nil {
+		logger.Error("Problem inserting batch: ", err)
+		if customTelemetryClient != nil {
+			customTelemetryClient.TrackException(err)
+		}
+		return
+	}
+
+	ids := make([]string, len(inserted))
+	for i, order := range inserted {
+		ids[i] = order.ID
+	}
+
+	if err := clients.Publisher.PublishBatch(ctx, ids); err != nil {
+		logger.Error("Problem publishing batch: ", err)
+		if customTelemetryClient != nil {
+			customTelemetryClient.TrackException(err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+	"os"
+
+	"github.com/Microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/sirupsen/logrus"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// Logger is the leveled logging interface used throughout models, in place of
+// ad-hoc calls to the stdlib log package. Implemented by logrusLogger below.
+type Logger interface {
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Notice(args ...interface{})
+	Warning(args ...interface{})
+	Error(args ...interface{})
+	Critical(args ...interface{})
+}
+
+// logrusLogger adapts *logrus.Logger to Logger. logrus has no Notice level,
+// so Notice logs at Info with a "level":"notice" field, and Critical logs at
+// Error since we never want a log call to os.Exit the process on its own.
+type logrusLogger struct {
+	*logrus.Logger
+}
+
+func (l *logrusLogger) Notice(args ...interface{}) {
+	l.WithField("level", "notice").Info(args...)
+}
+
+func (l *logrusLogger) Critical(args ...interface{}) {
+	l.WithField("level", "critical").Error(args...)
+}
+
+// newLogger builds the package Logger: logrus writing to stderr, optionally
+// tee'd to syslog via SYSLOG_ADDR, with an AppInsights hook so Warning+
+// entries show up alongside dependencies in App Insights.
+func newLogger(appInsightsClient appinsights.TelemetryClient) Logger {
+	base := logrus.New()
+	base.SetOutput(os.Stderr)
+
+	if addr := os.Getenv("SYSLOG_ADDR"); addr != "" {
+		hook, err := lsyslog.NewSyslogHook("udp", addr, syslog.LOG_INFO, "captureorderack")
+		if err != nil {
+			base.WithError(err).Warning("Could not connect to syslog, logging to stderr only")
+		} else {
+			base.AddHook(hook)
+		}
+	}
+
+	base.AddHook(&appInsightsHook{client: appInsightsClient})
+
+	return &logrusLogger{Logger: base}
+}
+
+// appInsightsHook forwards Warning+ log entries to AppInsights as trace
+// telemetry, so they show up alongside dependencies.
+type appInsightsHook struct {
+	client appinsights.TelemetryClient
+}
+
+func (h *appInsightsHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.WarnLevel, logrus.ErrorLevel, logrus.FatalLevel, logrus.PanicLevel}
+}
+
+func (h *appInsightsHook) Fire(entry *logrus.Entry) error {
+	if h.client == nil {
+		return nil
+	}
+
+	severity := appinsights.Warning
+	switch entry.Level {
+	case logrus.ErrorLevel:
+		severity = appinsights.Error
+	case logrus.FatalLevel, logrus.PanicLevel:
+		severity = appinsights.Critical
+	}
+
+	trace := appinsights.NewTraceTelemetry(entry.Message, severity)
+	for k, v := range entry.Data {
+		trace.Properties[k] = fmt.Sprintf("%v", v)
+	}
+	h.client.Track(trace)
+	return nil
+}
+
+// redactURL parses raw and blanks out any embedded userinfo before returning
+// it, so credentials never make it into a log line.
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return "(unparseable URL, redacted)"
+	}
+	parsed.User = nil
+	return parsed.String()
+}
@@ -0,0 +1,197 @@
+package models
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/ApplicationInsights-Go/appinsights"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoOrderStore is the OrderStore backed by MongoDB/CosmosDB.
+type mongoOrderStore struct {
+	session *mgo.Session
+	url     string
+}
+
+// newMongoStore dials MongoDB/CosmosDB, ensures the orders collection is
+// sharded on mongoCollectionShardKey, and returns an OrderStore backed by it.
+func newMongoStore(rawURL string) (OrderStore, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		if customTelemetryClient != nil {
+			customTelemetryClient.TrackException(err)
+		}
+		return nil, fmt.Errorf("parsing Mongo URL: %w", err)
+	}
+
+	if isCosmosDb {
+		logger.Info("Using CosmosDB")
+		db = "CosmosDB"
+	} else {
+		logger.Info("Using MongoDB")
+		db = "MongoDB"
+	}
+
+	// Parse the connection string to extract components because the MongoDB driver is peculiar
+	var dialInfo *mgo.DialInfo
+	mongoUsername := ""
+	mongoPassword := ""
+	if parsed.User != nil {
+		mongoUsername = parsed.User.Username()
+		mongoPassword, _ = parsed.User.Password()
+	}
+	mongoHost := parsed.Host
+	mongoDatabase := "db" // can be anything
+	mongoSSL := strings.Contains(parsed.RawQuery, "ssl=true")
+
+	// Never log credentials - only the redacted connection URL.
+	logger.Debug("Connecting to ", redactURL(rawURL))
+	logger.Debug(fmt.Sprintf("\tHost: %s", mongoHost))
+	logger.Debug(fmt.Sprintf("\tDatabase: %s", mongoDatabase))
+	logger.Debug(fmt.Sprintf("\tSSL: %t", mongoSSL))
+
+	if mongoSSL {
+		dialInfo = &mgo.DialInfo{
+			Addrs:    []string{mongoHost},
+			Timeout:  60 * time.Second,
+			Database: mongoDatabase, // It can be anything
+			Username: mongoUsername, // Username
+			Password: mongoPassword, // Password
+			DialServer: func(addr *mgo.ServerAddr) (net.Conn, error) {
+				return tls.Dial("tcp", addr.String(), &tls.Config{})
+			},
+		}
+	} else {
+		dialInfo = &mgo.DialInfo{
+			Addrs:    []string{mongoHost},
+			Timeout:  60 * time.Second,
+			Database: mongoDatabase, // It can be anything
+			Username: mongoUsername, // Username
+			Password: mongoPassword, // Password
+		}
+	}
+
+	// Create a session which maintains a pool of socket connections to our MongoDB.
+	startTime := time.Now()
+	session, dialErr := mgo.DialWithInfo(dialInfo)
+	trackMongoDependency(rawURL, "Create session", startTime, time.Now(), dialErr == nil)
+
+	if dialErr != nil {
+		return nil, fmt.Errorf("can't connect to mongo at [%s]: %w", redactURL(rawURL), dialErr)
+	}
+
+	// SetSafe changes the session's safety mode. If the safe parameter is nil, the
+	// session is put in unsafe mode, and writes become fire-and-forget, without
+	// error checking. The unsafe mode is faster since operations won't hold on
+	// waiting for a confirmation. http://godoc.org/labix.org/v2/mgo#Session.SetMode.
+	session.SetSafe(nil)
+
+	// Create a sharded collection and retrieve it
+	result := bson.M{}
+	err = session.DB(mongoDatabaseName).Run(
+		bson.D{
+			{
+				Name:  "shardCollection",
+				Value: fmt.Sprintf("%s.%s", mongoDatabaseName, mongoCollectionName),
+			},
+			{
+				Name: "key",
+				Value: bson.M{
+					mongoCollectionShardKey: "hashed",
+				},
+			},
+		}, &result)
+
+	if err != nil {
+		// The collection is most likely created and already sharded. I couldn't find a more elegant way to check this.
+		logger.Notice("Could not create/re-create sharded MongoDB collection. Either collection is already sharded or sharding is not supported: ", err)
+	} else {
+		logger.Info("Created MongoDB collection: ", result)
+	}
+
+	return &mongoOrderStore{session: session, url: rawURL}, nil
+}
+
+// Insert implements OrderStore.
+func (s *mongoOrderStore) Insert(ctx context.Context, order Order) (Order, error) {
+	sessionCopy := s.session.Copy()
+	defer sessionCopy.Close()
+
+	startTime := time.Now()
+	err := sessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).Insert(order)
+	trackMongoDependency(s.url, "Insert order", startTime, time.Now(), err == nil)
+
+	if err != nil {
+		return order, fmt.Errorf("inserting order %s: %w", order.ID, err)
+	}
+	return order, nil
+}
+
+// InsertBatch implements OrderStore as a single bulk write, so the batched
+// ingestion pipeline (see ingest.go) pays for one round trip per batch
+// instead of one per order.
+func (s *mongoOrderStore) InsertBatch(ctx context.Context, orders []Order) ([]Order, error) {
+	sessionCopy := s.session.Copy()
+	defer sessionCopy.Close()
+
+	docs := make([]interface{}, len(orders))
+	for i, order := range orders {
+		docs[i] = order
+	}
+
+	startTime := time.Now()
+	err := sessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).Insert(docs...)
+	trackMongoDependency(s.url, fmt.Sprintf("Insert batch of %d", len(orders)), startTime, time.Now(), err == nil)
+
+	if err != nil {
+		return orders, fmt.Errorf("inserting batch of %d orders: %w", len(orders), err)
+	}
+	return orders, nil
+}
+
+// Get implements OrderStore.
+func (s *mongoOrderStore) Get(ctx context.Context, id string) (Order, error) {
+	sessionCopy := s.session.Copy()
+	defer sessionCopy.Close()
+
+	var order Order
+	startTime := time.Now()
+	err := sessionCopy.DB(mongoDatabaseName).C(mongoCollectionName).Find(bson.M{"id": id}).One(&order)
+	trackMongoDependency(s.url, "Get order", startTime, time.Now(), err == nil)
+
+	if err != nil {
+		return Order{}, fmt.Errorf("getting order %s: %w", id, err)
+	}
+	return order, nil
+}
+
+// Close implements OrderStore.
+func (s *mongoOrderStore) Close() error {
+	s.session.Close()
+	return nil
+}
+
+// trackMongoDependency tracks a MongoDB/CosmosDB dependency, if the team
+// provided an Application Insights key.
+func trackMongoDependency(rawURL, operation string, startTime, endTime time.Time, success bool) {
+	if customTelemetryClient == nil {
+		return
+	}
+
+	name := "MongoDB"
+	if isCosmosDb {
+		name = "CosmosDB"
+	}
+
+	dependency := appinsights.NewRemoteDependencyTelemetry(name, "MongoDB", rawURL, success)
+	dependency.Data = operation
+	dependency.MarkTime(startTime, endTime)
+	customTelemetryClient.Track(dependency)
+}
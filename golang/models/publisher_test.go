@@ -0,0 +1,162 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	amqp091 "github.com/streadway/amqp"
+)
+
+func TestClassifyPublishError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want errClass
+	}{
+		{"nil", nil, classRetriable},
+		{"amqp access refused", &amqp091.Error{Code: amqp091.AccessRefused}, classTerminal},
+		{"amqp frame error", &amqp091.Error{Code: amqp091.FrameError}, classTerminal},
+		{"amqp connection forced", &amqp091.Error{Code: amqp091.ConnectionForced}, classRetriable},
+		{"auth failure", errors.New("unauthorized: bad credentials"), classTerminal},
+		{"malformed frame", errors.New("malformed frame received"), classTerminal},
+		{"timeout", errors.New("i/o timeout"), classRetriable},
+		{"connection reset", errors.New("connection reset by peer"), classRetriable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyPublishError(tt.err); got != tt.want {
+				t.Errorf("classifyPublishError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	tests := []struct {
+		current time.Duration
+		max     time.Duration
+		want    time.Duration
+	}{
+		{100 * time.Millisecond, 5 * time.Second, 200 * time.Millisecond},
+		{3 * time.Second, 5 * time.Second, 5 * time.Second},
+		{5 * time.Second, 5 * time.Second, 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := nextBackoff(tt.current, tt.max); got != tt.want {
+			t.Errorf("nextBackoff(%v, %v) = %v, want %v", tt.current, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestWithJitter(t *testing.T) {
+	d := 200 * time.Millisecond
+	for i := 0; i < 50; i++ {
+		got := withJitter(d)
+		if got < d || got > d+d/2 {
+			t.Fatalf("withJitter(%v) = %v, want in [%v, %v]", d, got, d, d+d/2)
+		}
+	}
+}
+
+// TestPublishWithRetryReconnectsBeforeRetrying guards against the retry loop
+// fast-failing through its whole backoff budget on "not connected" instead of
+// driving the reconnect itself - see the doc comment on publishWithRetry.
+func TestPublishWithRetryReconnectsBeforeRetrying(t *testing.T) {
+	p := &Publisher{
+		cfg: PublisherConfig{
+			MaxRetries:     3,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     5 * time.Millisecond,
+		},
+	}
+
+	var connectCalls, publishCalls int
+	p.connectFunc = func() error {
+		connectCalls++
+		p.connected = true
+		return nil
+	}
+	p.publishOnceFunc = func(body []byte) error {
+		publishCalls++
+		return nil
+	}
+
+	if err := p.publishWithRetry([]byte("body"), "test"); err != nil {
+		t.Fatalf("publishWithRetry returned error: %v", err)
+	}
+	if connectCalls != 1 {
+		t.Errorf("connectFunc called %d times, want 1", connectCalls)
+	}
+	if publishCalls != 1 {
+		t.Errorf("publishOnceFunc called %d times, want 1", publishCalls)
+	}
+}
+
+// TestPublishWithRetryRecoversAfterDisconnect simulates a publish that fails
+// because the connection dropped, then succeeds once reconnected - without
+// burning every attempt in cfg.MaxRetries on "not connected" first.
+func TestPublishWithRetryRecoversAfterDisconnect(t *testing.T) {
+	p := &Publisher{
+		cfg: PublisherConfig{
+			MaxRetries:     3,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     5 * time.Millisecond,
+		},
+		connected: true,
+	}
+
+	var connectCalls, publishCalls int
+	p.connectFunc = func() error {
+		connectCalls++
+		p.connected = true
+		return nil
+	}
+	p.publishOnceFunc = func(body []byte) error {
+		publishCalls++
+		if publishCalls == 1 {
+			p.connected = false
+			return errors.New("connection reset by peer")
+		}
+		return nil
+	}
+
+	if err := p.publishWithRetry([]byte("body"), "test"); err != nil {
+		t.Fatalf("publishWithRetry returned error: %v", err)
+	}
+	if connectCalls != 1 {
+		t.Errorf("connectFunc called %d times, want 1 (one reconnect after the dropped publish)", connectCalls)
+	}
+	if publishCalls != 2 {
+		t.Errorf("publishOnceFunc called %d times, want 2 (one failure, one success)", publishCalls)
+	}
+}
+
+// TestPublishWithRetryGivesUpOnTerminalError confirms a terminal error (e.g.
+// an auth failure) is not retried at all, connected or not.
+func TestPublishWithRetryGivesUpOnTerminalError(t *testing.T) {
+	p := &Publisher{
+		cfg: PublisherConfig{
+			MaxRetries:     3,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     5 * time.Millisecond,
+		},
+		connected: true,
+	}
+
+	var publishCalls int
+	p.connectFunc = func() error { return nil }
+	p.publishOnceFunc = func(body []byte) error {
+		publishCalls++
+		return errors.New("unauthorized: bad credentials")
+	}
+
+	if err := p.publishWithRetry([]byte("body"), "test"); err == nil {
+		t.Fatal("expected publishWithRetry to return an error")
+	}
+	if publishCalls != 1 {
+		t.Errorf("publishOnceFunc called %d times, want 1 (terminal errors aren't retried)", publishCalls)
+	}
+}
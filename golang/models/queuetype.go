@@ -0,0 +1,49 @@
+package models
+
+import (
+	"os"
+	"strings"
+)
+
+// QueueType identifies which AMQP backend amqpURL points at.
+type QueueType int
+
+// Supported queue backends. EventHub and ServiceBus both live under
+// servicebus.windows.net, so they can't be told apart by host alone -
+// QUEUETYPE lets an operator disambiguate explicitly.
+const (
+	QueueTypeRabbitMQ QueueType = iota
+	QueueTypeEventHub
+	QueueTypeServiceBus
+)
+
+func (q QueueType) String() string {
+	switch q {
+	case QueueTypeEventHub:
+		return "EventHub"
+	case QueueTypeServiceBus:
+		return "ServiceBus"
+	default:
+		return "RabbitMQ"
+	}
+}
+
+// detectQueueType figures out which AMQP backend url points at. The QUEUETYPE
+// env var always wins when set; otherwise it falls back to host sniffing,
+// defaulting ambiguous servicebus.windows.net hosts to EventHub for
+// backwards compatibility with existing deployments.
+func detectQueueType(url string) QueueType {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("QUEUETYPE"))) {
+	case "servicebus":
+		return QueueTypeServiceBus
+	case "eventhub":
+		return QueueTypeEventHub
+	case "rabbitmq":
+		return QueueTypeRabbitMQ
+	}
+
+	if strings.Contains(url, "servicebus.windows.net") {
+		return QueueTypeEventHub
+	}
+	return QueueTypeRabbitMQ
+}
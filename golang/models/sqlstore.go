@@ -0,0 +1,181 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Microsoft/ApplicationInsights-Go/appinsights"
+	_ "github.com/lib/pq"
+)
+
+// sqlOrderStore is the OrderStore backed by database/sql, supporting both
+// PostgreSQL and CockroachDB (lib/pq speaks the Postgres wire protocol both
+// implement).
+type sqlOrderStore struct {
+	db          *sql.DB
+	dialectName string // "PostgreSQL" or "CockroachDB", for AppInsights dependency typing
+
+	insertStmt *sql.Stmt
+	getStmt    *sql.Stmt
+}
+
+// newSQLStore opens rawURL with lib/pq, creates the orders table (with a hash
+// index on product - hash-sharded on CockroachDB, like the Mongo store's
+// mongoCollectionShardKey - see createOrdersTable), and prepares the
+// statements Insert/Get use on every call.
+func newSQLStore(rawURL string) (OrderStore, error) {
+	dialectName := "PostgreSQL"
+	if isCockroachDB(rawURL) {
+		dialectName = "CockroachDB"
+	}
+
+	logger.Info("Using " + dialectName)
+	logger.Debug("Connecting to ", redactURL(rawURL))
+
+	startTime := time.Now()
+	db, err := sql.Open("postgres", rawURL)
+	if err == nil {
+		err = db.Ping()
+	}
+	trackSQLDependency(dialectName, rawURL, "Open connection", startTime, time.Now(), err == nil)
+	if err != nil {
+		if customTelemetryClient != nil {
+			customTelemetryClient.TrackException(err)
+		}
+		return nil, fmt.Errorf("connecting to %s at [%s]: %w", dialectName, redactURL(rawURL), err)
+	}
+
+	if err := createOrdersTable(db, dialectName); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	insertStmt, err := db.Prepare(`
+		INSERT INTO orders (id, email_address, preferred_language, product, total, source, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("preparing insert statement: %w", err)
+	}
+
+	getStmt, err := db.Prepare(`
+		SELECT id, email_address, preferred_language, product, total, source, status
+		FROM orders WHERE id = $1`)
+	if err != nil {
+		insertStmt.Close()
+		db.Close()
+		return nil, fmt.Errorf("preparing get statement: %w", err)
+	}
+
+	return &sqlOrderStore{db: db, dialectName: dialectName, insertStmt: insertStmt, getStmt: getStmt}, nil
+}
+
+// createOrdersTable creates the orders table and an index on product: on
+// CockroachDB a hash-sharded index, matching the Mongo store's shard key
+// semantics; on PostgreSQL a plain (unsharded) hash index.
+func createOrdersTable(db *sql.DB, dialectName string) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS orders (
+			id                 TEXT PRIMARY KEY,
+			email_address      TEXT,
+			preferred_language TEXT,
+			product            TEXT,
+			total              DOUBLE PRECISION,
+			source             TEXT,
+			status             TEXT
+		)`)
+	if err != nil {
+		return fmt.Errorf("creating orders table: %w", err)
+	}
+
+	if dialectName == "CockroachDB" {
+		// CockroachDB hash-sharded index: rows are bucketed on a hidden hash
+		// of product, mirroring the Mongo store's "product": "hashed" shard key.
+		_, err = db.Exec(`CREATE INDEX IF NOT EXISTS orders_product_shard_idx ON orders (product) USING HASH WITH BUCKET_COUNT = 8`)
+	} else {
+		_, err = db.Exec(`CREATE INDEX IF NOT EXISTS orders_product_idx ON orders USING HASH (product)`)
+	}
+	if err != nil {
+		logger.Notice("Could not create product shard index. It may already exist: ", err)
+	}
+	return nil
+}
+
+// Insert implements OrderStore.
+func (s *sqlOrderStore) Insert(ctx context.Context, order Order) (Order, error) {
+	startTime := time.Now()
+	_, err := s.insertStmt.ExecContext(ctx,
+		order.ID, order.EmailAddress, order.PreferredLanguage, order.Product, order.Total, order.Source, order.Status)
+	trackSQLDependency(s.dialectName, "", "Insert order", startTime, time.Now(), err == nil)
+
+	if err != nil {
+		return order, fmt.Errorf("inserting order %s: %w", order.ID, err)
+	}
+	return order, nil
+}
+
+// InsertBatch implements OrderStore as a single transaction, so the batched
+// ingestion pipeline (see ingest.go) pays for one commit per batch instead of
+// one per order. Each order is still its own INSERT round trip.
+func (s *sqlOrderStore) InsertBatch(ctx context.Context, orders []Order) ([]Order, error) {
+	startTime := time.Now()
+	operation := fmt.Sprintf("Insert batch of %d", len(orders))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return orders, fmt.Errorf("beginning batch insert transaction: %w", err)
+	}
+
+	stmt := tx.StmtContext(ctx, s.insertStmt)
+	for _, order := range orders {
+		if _, err := stmt.ExecContext(ctx,
+			order.ID, order.EmailAddress, order.PreferredLanguage, order.Product, order.Total, order.Source, order.Status); err != nil {
+			tx.Rollback()
+			trackSQLDependency(s.dialectName, "", operation, startTime, time.Now(), false)
+			return orders, fmt.Errorf("inserting batch of %d orders: %w", len(orders), err)
+		}
+	}
+
+	err = tx.Commit()
+	trackSQLDependency(s.dialectName, "", operation, startTime, time.Now(), err == nil)
+	if err != nil {
+		return orders, fmt.Errorf("committing batch of %d orders: %w", len(orders), err)
+	}
+	return orders, nil
+}
+
+// Get implements OrderStore.
+func (s *sqlOrderStore) Get(ctx context.Context, id string) (Order, error) {
+	var order Order
+	startTime := time.Now()
+	err := s.getStmt.QueryRowContext(ctx, id).Scan(
+		&order.ID, &order.EmailAddress, &order.PreferredLanguage, &order.Product, &order.Total, &order.Source, &order.Status)
+	trackSQLDependency(s.dialectName, "", "Get order", startTime, time.Now(), err == nil)
+
+	if err != nil {
+		return Order{}, fmt.Errorf("getting order %s: %w", id, err)
+	}
+	return order, nil
+}
+
+// Close implements OrderStore.
+func (s *sqlOrderStore) Close() error {
+	s.insertStmt.Close()
+	s.getStmt.Close()
+	return s.db.Close()
+}
+
+// trackSQLDependency tracks a PostgreSQL/CockroachDB dependency, if the team
+// provided an Application Insights key.
+func trackSQLDependency(dialectName, target, operation string, startTime, endTime time.Time, success bool) {
+	if customTelemetryClient == nil {
+		return
+	}
+
+	dependency := appinsights.NewRemoteDependencyTelemetry(dialectName, dialectName, target, success)
+	dependency.Data = operation
+	dependency.MarkTime(startTime, endTime)
+	customTelemetryClient.Track(dependency)
+}
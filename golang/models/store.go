@@ -0,0 +1,53 @@
+package models
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// OrderStore abstracts order persistence so callers don't need to know
+// whether orders land in MongoDB/CosmosDB or a SQL database. See
+// mongostore.go and sqlstore.go for the two implementations.
+type OrderStore interface {
+	Insert(ctx context.Context, order Order) (Order, error)
+	InsertBatch(ctx context.Context, orders []Order) ([]Order, error)
+	Get(ctx context.Context, id string) (Order, error)
+	Close() error
+}
+
+// storeURL picks the connection string for dialStore: DBURL if set,
+// otherwise the existing MONGOURL.
+func storeURL() string {
+	if dbURL := os.Getenv("DBURL"); dbURL != "" {
+		return dbURL
+	}
+	return mongoURL
+}
+
+// isSQLConnectionString reports whether url points at a database/sql-backed
+// store (PostgreSQL or CockroachDB) rather than MongoDB/CosmosDB.
+func isSQLConnectionString(url string) bool {
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		return true
+	}
+	return isCockroachDB(url)
+}
+
+// isCockroachDB reports whether url looks like a CockroachDB (as opposed to
+// vanilla PostgreSQL) connection string.
+func isCockroachDB(url string) bool {
+	if strings.Contains(url, "cockroachlabs.cloud") {
+		return true
+	}
+	return strings.Contains(url, "sslmode=verify-full") && strings.Contains(url, "26257")
+}
+
+// dialStore connects to whichever backend storeURL() selects.
+func dialStore() (OrderStore, error) {
+	url := storeURL()
+	if isSQLConnectionString(url) {
+		return newSQLStore(url)
+	}
+	return newMongoStore(url)
+}